@@ -3,14 +3,34 @@
 package dht
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	log "github.com/sirupsen/logrus"
 	"math"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// Mode selects which of the Node's handlers New wires up.
+type Mode int
+
+const (
+	// ModeClient issues lookups but does not answer incoming DHT queries.
+	// Values start at 1 so that an unset Mode (0) selects ModeFull in New.
+	ModeClient Mode = iota + 1
+	// ModeServer answers incoming DHT queries but does not issue lookups of
+	// its own beyond what's needed to stay connected to the network.
+	ModeServer
+	// ModeFull both issues lookups and answers incoming DHT queries. This is
+	// the default, and matches the behavior of earlier versions of this
+	// package that didn't distinguish the two.
+	ModeFull
+)
+
 // Config represents the configure of dht.
 type Config struct {
 	// in mainline dht, k = 8
@@ -45,6 +65,20 @@ type Config struct {
 	PacketWorkerLimit int
 	// the nodes num to be fresh in a kbucket
 	RefreshNodeNum int
+	// the number of concurrent find_node/find_value queries an iterative
+	// lookup keeps in flight at once. Defaults to 3 if unset.
+	Alpha int
+	// Mode selects which handlers New wires up: ModeClient, ModeServer or
+	// ModeFull. Defaults to ModeFull.
+	Mode Mode
+	// PersistPath, if set, is where the routing table is snapshotted to and
+	// reloaded from across restarts. Ignored if RoutingTableStore is set.
+	PersistPath string
+	// RoutingTableStore, if set, overrides PersistPath with a caller-supplied
+	// place to load/save routing table snapshots.
+	RoutingTableStore RoutingTableStore
+	// how often the routing table is snapshotted to RoutingTableStore.
+	PersistInterval time.Duration
 }
 
 // NewStandardConfig returns a Config pointer with default values.
@@ -68,11 +102,18 @@ func NewStandardConfig() *Config {
 		PacketJobLimit:       1024,
 		PacketWorkerLimit:    256,
 		RefreshNodeNum:       8,
+		Alpha:                3,
+		Mode:                 ModeFull,
+		PersistInterval:      time.Minute * 5,
 	}
 }
 
-// DHT represents a DHT node.
-type DHT struct {
+// Node is the DHT engine shared by ClientHandler and ServerHandler: the
+// local contact, routing table, transaction manager and UDP socket. It
+// knows how to join the network, issue lookups and dispatch incoming
+// packets, but whether it answers other nodes' queries is up to whichever
+// handler(s) are built on top of it.
+type Node struct {
 	*Config
 	node               *node
 	conn               *net.UDPConn
@@ -83,83 +124,173 @@ type DHT struct {
 	Ready              bool
 	packets            chan packet
 	workerTokens       chan struct{}
+	store              RoutingTableStore
+	shutdown           chan struct{}
+	shutdownOnce       sync.Once
+	// serve is set by newServerHandler. When false, incoming queries are
+	// dropped in listen() before they reach handle(), so a Node with no
+	// ServerHandler never answers other nodes' requests.
+	serve bool
+	// contactSeen tracks when each contact (keyed by raw node id) was last
+	// confirmed alive, for routing table snapshotting; see touchContact.
+	contactSeenMu sync.Mutex
+	contactSeen   map[string]time.Time
 }
 
-// New returns a DHT pointer. If config is nil, then config will be set to
-// the default config.
-func New(config *Config) *DHT {
+// newNodeCore returns a Node pointer. If config is nil, then config will be
+// set to the default config.
+func newNodeCore(config *Config) *Node {
 	if config == nil {
 		config = NewStandardConfig()
 	}
 
-	node, err := newNode(randomString(nodeIDLength), config.Network, config.Address)
+	self, err := newNode(randomString(nodeIDLength), config.Network, config.Address)
 	if err != nil {
 		panic(err)
 	}
 
-	d := &DHT{
+	n := &Node{
 		Config:       config,
-		node:         node,
+		node:         self,
 		packets:      make(chan packet, config.PacketJobLimit),
 		workerTokens: make(chan struct{}, config.PacketWorkerLimit),
+		shutdown:     make(chan struct{}),
+		contactSeen:  map[string]time.Time{},
 	}
 
-	return d
+	if config.RoutingTableStore != nil {
+		n.store = config.RoutingTableStore
+	} else if config.PersistPath != "" {
+		n.store = &fileRoutingTableStore{Path: config.PersistPath}
+	}
+
+	return n
 }
 
 // init initializes global variables.
-func (dht *DHT) init() {
-	log.Info("Initializing DHT on " + dht.Address)
-	log.Infof("Node ID is %s", dht.node.HexID())
-	listener, err := net.ListenPacket(dht.Network, dht.Address)
+func (n *Node) init() {
+	log.Info("Initializing DHT on " + n.Address)
+	log.Infof("Node ID is %s", n.node.HexID())
+	listener, err := net.ListenPacket(n.Network, n.Address)
 	if err != nil {
 		panic(err)
 	}
 
-	dht.conn = listener.(*net.UDPConn)
-	dht.routingTable = newRoutingTable(dht.K, dht)
-	dht.peersManager = newPeersManager(dht)
-	dht.tokenManager = newTokenManager(dht.TokenExpiredAfter, dht)
-	dht.transactionManager = newTransactionManager(dht.MaxTransactionCursor, dht)
+	n.conn = listener.(*net.UDPConn)
+	n.routingTable = newRoutingTable(n.K, n)
+	n.peersManager = newPeersManager(n)
+	n.tokenManager = newTokenManager(n.TokenExpiredAfter, n)
+	n.transactionManager = newTransactionManager(n.MaxTransactionCursor, n)
 
-	go dht.transactionManager.run()
-	go dht.tokenManager.clear()
+	go n.transactionManager.run()
+	go n.tokenManager.clear()
 }
 
 // join makes current node join the dht network.
-func (dht *DHT) join() {
-	for _, addr := range dht.PrimeNodes {
-		raddr, err := net.ResolveUDPAddr(dht.Network, addr)
+func (n *Node) join() {
+	for _, addr := range n.PrimeNodes {
+		raddr, err := net.ResolveUDPAddr(n.Network, addr)
 		if err != nil {
 			continue
 		}
 
 		// NOTE: Temporary node has NO node id.
-		dht.transactionManager.findNode(
+		n.transactionManager.findNode(
+			context.Background(),
 			&node{addr: raddr},
-			dht.node.id.RawString(),
+			n.node.id.RawString(),
 		)
 	}
 }
 
-// listen receives message from udp.
-func (dht *DHT) listen() {
+// bencodeDictValue returns the decoded string value of key in the top-level
+// bencoded dict raw, e.g. bencodeDictValue(raw, "y") finds "q" in
+// "d1:ad...e1:y1:qe". It takes the first occurrence of the bencoded key
+// anywhere in raw that is followed by a bencoded string; it does not walk the
+// dict structure, so an occurrence inside a nested value that comes before
+// the top-level key is matched instead.
+func bencodeDictValue(raw []byte, key string) (string, bool) {
+	needle := []byte(strconv.Itoa(len(key)) + ":" + key)
+	idx := bytes.Index(raw, needle)
+	if idx < 0 {
+		return "", false
+	}
+
+	rest := raw[idx+len(needle):]
+	colon := bytes.IndexByte(rest, ':')
+	if colon < 0 {
+		return "", false
+	}
+
+	n, err := strconv.Atoi(string(rest[:colon]))
+	if err != nil || n < 0 || colon+1+n > len(rest) {
+		return "", false
+	}
+	return string(rest[colon+1 : colon+1+n]), true
+}
+
+// isQuery reports whether raw is an incoming KRPC query message, by decoding
+// its "y" (message type) value rather than scanning for a fixed byte string.
+func isQuery(raw []byte) bool {
+	y, ok := bencodeDictValue(raw, "y")
+	return ok && y == "q"
+}
+
+// decodeTransactionID returns the transaction id raw's "t" value encodes, the
+// same id encodeQuery wrote into the outgoing query it's a response to.
+func decodeTransactionID(raw []byte) (uint64, bool) {
+	t, ok := bencodeDictValue(raw, "t")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(t, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// listen receives message from udp. Nodes with no ServerHandler drop
+// incoming queries here, before they ever reach handle(), so they can never
+// answer other nodes' get_peers/announce_peer/find_node requests. Incoming
+// responses are matched back to the transaction that's waiting on them so
+// its retry loop can stop and free its worker token right away, instead of
+// always running out the clock.
+func (n *Node) listen() {
 	go func() {
 		buff := make([]byte, 8192)
 		for {
-			n, raddr, err := dht.conn.ReadFromUDP(buff)
+			r, raddr, err := n.conn.ReadFromUDP(buff)
 			if err != nil {
 				continue
 			}
+			raw := buff[:r]
+
+			if isQuery(raw) {
+				if !n.serve {
+					continue
+				}
+			} else if id, ok := decodeTransactionID(raw); ok {
+				n.transactionManager.complete(id)
+			}
 
-			dht.packets <- packet{buff[:n], raddr}
+			n.packets <- packet{buff[:r], raddr}
 		}
 	}()
 }
 
-// FindNode returns peers who have announced having key.
-func (dht *DHT) FindNode(key string) ([]*Peer, error) {
-	if !dht.Ready {
+// FindNode returns peers who have announced having key. It blocks for up to
+// 30 seconds; use FindNodeContext to control the deadline or cancel early.
+func (n *Node) FindNode(key string) ([]*Peer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return n.FindNodeContext(ctx, key)
+}
+
+// FindNodeContext returns peers who have announced having key, aborting the
+// lookup and returning ctx.Err() as soon as ctx is done.
+func (n *Node) FindNodeContext(ctx context.Context, key string) ([]*Peer, error) {
+	if !n.Ready {
 		return nil, errors.New("dht not ready")
 	}
 
@@ -171,58 +302,121 @@ func (dht *DHT) FindNode(key string) ([]*Peer, error) {
 		key = string(data)
 	}
 
-	peers := dht.peersManager.GetPeers(key, dht.K)
+	peers := n.peersManager.GetPeers(key, n.K)
 	if len(peers) != 0 {
 		return peers, nil
 	}
 
-	ch := make(chan struct{})
-
-	go func() {
-		neighbors := dht.routingTable.GetNeighbors(newBitmapFromString(key), dht.K)
-
-		for _, no := range neighbors {
-			dht.transactionManager.findNode(no, key)
-		}
-
-		i := 0
-		for range time.Tick(time.Second * 1) {
-			i++
-			peers = dht.peersManager.GetPeers(key, dht.K)
-			if len(peers) != 0 || i >= 30 {
-				break
-			}
-		}
-
-		ch <- struct{}{}
-	}()
-
-	<-ch
-	return peers, nil
+	return n.iterativeFindValue(ctx, key)
 }
 
-// Run starts the dht.
-func (dht *DHT) Run() {
-	dht.init()
-	dht.listen()
-	dht.join()
+// run starts the packet loop that dispatches incoming packets and keeps the
+// routing table fresh. Whether incoming queries get answered depends on
+// n.serve, which listen() already used to decide whether to even hand this
+// loop the packet; by the time handle() runs here, a Node with no
+// ServerHandler has never seen a query in the first place.
+func (n *Node) run() {
+	n.init()
+	n.restoreRoutingTable()
+	n.listen()
+	n.join()
 
-	dht.Ready = true
+	if n.store != nil {
+		go n.persistLoop()
+	}
+
+	n.Ready = true
 	log.Info("DHT ready")
 
 	var pkt packet
-	tick := time.Tick(dht.CheckKBucketPeriod)
+	tick := time.Tick(n.CheckKBucketPeriod)
 
 	for {
 		select {
-		case pkt = <-dht.packets:
-			handle(dht, pkt)
+		case <-n.shutdown:
+			return
+		case pkt = <-n.packets:
+			handle(n, pkt)
 		case <-tick:
-			if dht.routingTable.Len() == 0 {
-				dht.join()
-			} else if dht.transactionManager.len() == 0 {
-				go dht.routingTable.Fresh()
+			if n.routingTable.Len() == 0 {
+				n.join()
+			} else if n.transactionManager.len() == 0 {
+				go n.routingTable.Fresh()
 			}
 		}
 	}
 }
+
+// Shutdown stops the packet loop, closes the UDP socket, and flushes a final
+// routing table snapshot to the configured RoutingTableStore, if any.
+func (n *Node) Shutdown() error {
+	n.shutdownOnce.Do(func() {
+		close(n.shutdown)
+		if n.conn != nil {
+			n.conn.Close()
+		}
+	})
+	if n.routingTable == nil {
+		// init() never ran, so there's nothing to flush.
+		return nil
+	}
+	return n.persistRoutingTable()
+}
+
+// touchContact records that the contact with the given raw node id was just
+// seen alive, so a later routing table snapshot reflects real freshness
+// instead of the time it happened to be saved.
+func (n *Node) touchContact(id string) {
+	n.contactSeenMu.Lock()
+	defer n.contactSeenMu.Unlock()
+	n.contactSeen[id] = time.Now()
+}
+
+// contactLastSeen returns the last time id was confirmed alive, if ever.
+func (n *Node) contactLastSeen(id string) (time.Time, bool) {
+	n.contactSeenMu.Lock()
+	defer n.contactSeenMu.Unlock()
+	t, ok := n.contactSeen[id]
+	return t, ok
+}
+
+// DHT represents a DHT node running with whichever of ClientHandler and
+// ServerHandler its Config.Mode selects. It is kept around as a
+// backwards-compatible wrapper over the Node/ClientHandler/ServerHandler
+// split. ClientHandler and ServerHandler have no exported constructors; a
+// DHT that runs only one side is built by New with Config.Mode set to
+// ModeClient or ModeServer.
+type DHT struct {
+	*Node
+	client *ClientHandler
+	server *ServerHandler
+}
+
+// New returns a DHT pointer. If config is nil, then config will be set to
+// the default config.
+func New(config *Config) *DHT {
+	if config == nil {
+		config = NewStandardConfig()
+	}
+
+	n := newNodeCore(config)
+	d := &DHT{Node: n}
+
+	switch config.Mode {
+	case ModeClient:
+		d.client = newClientHandler(n)
+	case ModeServer:
+		d.server = newServerHandler(n)
+	default:
+		d.client = newClientHandler(n)
+		d.server = newServerHandler(n)
+	}
+
+	return d
+}
+
+// Run starts the dht, serving incoming queries if Config.Mode is ModeServer
+// or ModeFull.
+func (dht *DHT) Run() {
+	dht.Node.run()
+}
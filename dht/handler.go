@@ -0,0 +1,39 @@
+package dht
+
+// ClientHandler drives a Node purely to issue lookups: queries from other
+// nodes (get_peers/announce_peer/find_node) are dropped at the socket layer
+// before they ever reach handle(), so they go unanswered regardless of
+// Config.OnGetPeers/OnAnnouncePeer. It's meant for embedding DHT lookups in
+// resource-constrained or short-lived processes, such as mobile apps or CLI
+// tools, that only need to resolve peers for a handful of keys.
+type ClientHandler struct {
+	*Node
+}
+
+func newClientHandler(n *Node) *ClientHandler {
+	return &ClientHandler{Node: n}
+}
+
+// Run starts the client: it joins the network and serves responses to its
+// own outstanding lookups, but answers no one else's queries.
+func (c *ClientHandler) Run() {
+	c.Node.run()
+}
+
+// ServerHandler drives a Node as a full network participant: it answers
+// get_peers/announce_peer/find_node requests from other nodes so they can
+// route through and store with it.
+type ServerHandler struct {
+	*Node
+}
+
+func newServerHandler(n *Node) *ServerHandler {
+	n.serve = true
+	return &ServerHandler{Node: n}
+}
+
+// Run starts the server: it joins the network, keeps its routing table
+// fresh, and answers incoming get_peers/announce_peer/find_node requests.
+func (s *ServerHandler) Run() {
+	s.Node.run()
+}
@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// roundWait is how long an iterative lookup round gives outstanding queries
+// to land their responses in the routing table/peers manager before the
+// shortlist is re-evaluated.
+const roundWait = 300 * time.Millisecond
+
+// shortlistEntry tracks a candidate contact discovered during an iterative
+// lookup and whether it has already been queried.
+type shortlistEntry struct {
+	node      *node
+	contacted bool
+}
+
+// xorDistance returns the bytewise XOR distance between two raw node/key
+// strings, used to order the shortlist by closeness to the lookup target.
+func xorDistance(a, b string) []byte {
+	l := len(a)
+	if len(b) < l {
+		l = len(b)
+	}
+	d := make([]byte, l)
+	for i := 0; i < l; i++ {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closerThan reports whether distance x is smaller than distance y.
+func closerThan(x, y []byte) bool {
+	for i := range x {
+		if x[i] != y[i] {
+			return x[i] < y[i]
+		}
+	}
+	return false
+}
+
+// iterativeLookup drives an alpha-parallel Kademlia lookup for key over a
+// shortlist sorted by XOR distance: it keeps at most alpha queries (issued via send) outstanding,
+// folds newly-seen contacts into the shortlist, and stops once a full round
+// turns up nothing closer than what's already known. onProbe is called after
+// each round to let the caller check for a find_value hit; returning true
+// stops the lookup immediately.
+func (n *Node) iterativeLookup(ctx context.Context, key string, send func(context.Context, *node, string), onProbe func() bool) ([]*node, error) {
+	alpha := n.Alpha
+	if alpha <= 0 {
+		alpha = 3
+	}
+
+	var mu sync.Mutex
+	shortlist := map[string]*shortlistEntry{}
+	addContacts := func(contacts []*node) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range contacts {
+			id := c.id.RawString()
+			if _, ok := shortlist[id]; !ok {
+				shortlist[id] = &shortlistEntry{node: c}
+			}
+		}
+	}
+
+	addContacts(n.routingTable.GetNeighbors(newBitmapFromString(key), n.K))
+
+	for {
+		mu.Lock()
+		entries := make([]*shortlistEntry, 0, len(shortlist))
+		for _, e := range shortlist {
+			entries = append(entries, e)
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return closerThan(xorDistance(entries[i].node.id.RawString(), key), xorDistance(entries[j].node.id.RawString(), key))
+		})
+
+		var round []*node
+		for _, e := range entries {
+			if !e.contacted {
+				e.contacted = true
+				round = append(round, e.node)
+				if len(round) == alpha {
+					break
+				}
+			}
+		}
+		var closestBefore []byte
+		if len(entries) > n.K {
+			entries = entries[:n.K]
+		}
+		if len(entries) > 0 {
+			closestBefore = xorDistance(entries[0].node.id.RawString(), key)
+		}
+		mu.Unlock()
+
+		if len(round) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, no := range round {
+			wg.Add(1)
+			go func(no *node) {
+				defer wg.Done()
+				send(ctx, no, key)
+			}(no)
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-done:
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(roundWait):
+		}
+
+		if onProbe != nil && onProbe() {
+			break
+		}
+
+		addContacts(n.routingTable.GetNeighbors(newBitmapFromString(key), n.K))
+
+		mu.Lock()
+		var closestAfter []byte
+		for _, e := range shortlist {
+			d := xorDistance(e.node.id.RawString(), key)
+			if closestAfter == nil || closerThan(d, closestAfter) {
+				closestAfter = d
+			}
+		}
+		mu.Unlock()
+
+		if closestBefore != nil && closestAfter != nil && !closerThan(closestAfter, closestBefore) {
+			// this round didn't turn up anything closer than what we already
+			// had, so the lookup has converged.
+			break
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	entries := make([]*shortlistEntry, 0, len(shortlist))
+	for _, e := range shortlist {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return closerThan(xorDistance(entries[i].node.id.RawString(), key), xorDistance(entries[j].node.id.RawString(), key))
+	})
+	if len(entries) > n.K {
+		entries = entries[:n.K]
+	}
+	closest := make([]*node, len(entries))
+	for i, e := range entries {
+		closest[i] = e.node
+	}
+	return closest, nil
+}
+
+// iterativeFindNode runs an iterative lookup for key, issuing find_node RPCs,
+// and returns the k closest live contacts found, without regard to whether
+// any of them reported having a value for key.
+func (n *Node) iterativeFindNode(ctx context.Context, key string) ([]*node, error) {
+	return n.iterativeLookup(ctx, key, n.transactionManager.findNode, nil)
+}
+
+// iterativeFindValue runs an iterative lookup for key, issuing find_value
+// RPCs and terminating early to return the peers reported for key as soon as
+// any queried node responds with a value hit.
+func (n *Node) iterativeFindValue(ctx context.Context, key string) ([]*Peer, error) {
+	var peers []*Peer
+	_, err := n.iterativeLookup(ctx, key, n.transactionManager.findValue, func() bool {
+		peers = n.peersManager.GetPeers(key, n.K)
+		return len(peers) != 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PersistedNode is a snapshot of a single routing table contact: enough to
+// reconnect to it and decide whether it's still worth trusting.
+type PersistedNode struct {
+	ID       string    `json:"id"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// RoutingTableStore loads and saves routing table snapshots so a restarted
+// DHT doesn't have to re-bootstrap from PrimeNodes. Load returns a nil slice
+// and no error when no snapshot exists yet.
+type RoutingTableStore interface {
+	Load() ([]PersistedNode, error)
+	Save(nodes []PersistedNode) error
+}
+
+// fileRoutingTableStore is the RoutingTableStore used when Config.PersistPath
+// is set without a custom RoutingTableStore: a JSON snapshot at Path.
+type fileRoutingTableStore struct {
+	Path string
+}
+
+func (s *fileRoutingTableStore) Load() ([]PersistedNode, error) {
+	data, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var nodes []PersistedNode
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (s *fileRoutingTableStore) Save(nodes []PersistedNode) error {
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file and rename so a crash mid-write can't leave a
+	// truncated snapshot behind.
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// restoreRoutingTable loads a routing table snapshot, drops anything older
+// than NodeExpriedAfter, and seeds the rest into the routing table so join()
+// isn't the only way it gets populated. Each restored contact is also
+// re-pinged so a stale or reassigned address gets its freshness confirmed
+// (or evicted by the routing table's own staleness handling) rather than
+// being trusted purely on the snapshot's say-so.
+func (n *Node) restoreRoutingTable() {
+	if n.store == nil {
+		return
+	}
+
+	saved, err := n.store.Load()
+	if err != nil {
+		log.Warnf("failed to load routing table snapshot: %v", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-n.NodeExpriedAfter)
+	for _, pn := range saved {
+		if pn.LastSeen.Before(cutoff) {
+			continue
+		}
+
+		raddr, err := net.ResolveUDPAddr(n.Network, pn.Addr)
+		if err != nil {
+			continue
+		}
+
+		restored := &node{id: newBitmapFromString(pn.ID), addr: raddr}
+		n.routingTable.Insert(restored)
+		n.transactionManager.findNode(context.Background(), restored, n.node.id.RawString())
+	}
+}
+
+// persistLoop snapshots the routing table to n.store on PersistInterval
+// until the node shuts down.
+func (n *Node) persistLoop() {
+	interval := n.PersistInterval
+	if interval <= 0 {
+		interval = time.Minute * 5
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.shutdown:
+			return
+		case <-ticker.C:
+			if err := n.persistRoutingTable(); err != nil {
+				log.Warnf("failed to persist routing table snapshot: %v", err)
+			}
+		}
+	}
+}
+
+// persistRoutingTable saves the current routing table contacts to n.store.
+func (n *Node) persistRoutingTable() error {
+	if n.store == nil {
+		return nil
+	}
+
+	contacts := n.routingTable.GetNeighbors(n.node.id, n.MaxNodes)
+	nodes := make([]PersistedNode, len(contacts))
+	for i, c := range contacts {
+		id := c.id.RawString()
+		// lastSeen is the zero time if we've never actually confirmed this
+		// contact alive (e.g. it was restored from a snapshot but hasn't
+		// responded to anything since); that's intentional, since claiming
+		// it's fresh would let a stale contact keep resurrecting itself.
+		lastSeen, _ := n.contactLastSeen(id)
+		nodes[i] = PersistedNode{
+			ID:       id,
+			Addr:     c.addr.String(),
+			LastSeen: lastSeen,
+		}
+	}
+
+	return n.store.Save(nodes)
+}
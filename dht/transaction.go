@@ -0,0 +1,195 @@
+package dht
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queryTimeout is how long a single find_node/find_value attempt waits for a
+// response before it's retried.
+const queryTimeout = 5 * time.Second
+
+// transaction tracks a single outstanding query sent to a remote node.
+type transaction struct {
+	id       uint64
+	remoteID string
+	done     chan struct{}
+}
+
+// transactionManager tracks outstanding queries sent to other nodes. Each
+// query carries the context it was issued with, and its retry/timeout loop
+// gives up and frees its worker token the moment that context is done,
+// rather than running out its remaining retries first.
+type transactionManager struct {
+	node *Node
+
+	mu     sync.Mutex
+	cursor uint64
+	max    uint64
+	txns   map[uint64]*transaction
+}
+
+func newTransactionManager(max uint64, n *Node) *transactionManager {
+	return &transactionManager{
+		node: n,
+		max:  max,
+		txns: map[uint64]*transaction{},
+	}
+}
+
+// run exists for symmetry with the other managers' clear()/run() background
+// loops; transaction retry/timeout is driven per-transaction by query's own
+// goroutine, so there's no shared loop to run.
+func (t *transactionManager) run() {}
+
+// len returns the number of outstanding transactions.
+func (t *transactionManager) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.txns)
+}
+
+func (t *transactionManager) nextID() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cursor++
+	if t.cursor > t.max {
+		t.cursor = 0
+	}
+	return t.cursor
+}
+
+// findNode issues a find_node query to no for key.
+func (t *transactionManager) findNode(ctx context.Context, no *node, key string) {
+	t.query(ctx, no, "find_node", key)
+}
+
+// findValue issues a find_value query to no for key.
+func (t *transactionManager) findValue(ctx context.Context, no *node, key string) {
+	t.query(ctx, no, "find_value", key)
+}
+
+// query registers a transaction and hands it off to manage for its
+// retry/timeout lifecycle, returning as soon as a worker token is acquired
+// so callers (like an iterative lookup round) don't block on the network
+// round trip.
+func (t *transactionManager) query(ctx context.Context, no *node, kind, key string) {
+	select {
+	case t.node.workerTokens <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+
+	// temporary nodes used to join through PrimeNodes have no id.
+	remoteID := ""
+	if no.id != nil {
+		remoteID = no.id.RawString()
+	}
+	txn := &transaction{id: t.nextID(), remoteID: remoteID, done: make(chan struct{})}
+	t.mu.Lock()
+	t.txns[txn.id] = txn
+	t.mu.Unlock()
+
+	go t.manage(ctx, txn, no, kind, key)
+}
+
+// complete marks the transaction with the given id done, if it's still
+// outstanding, so manage's retry loop returns and frees its worker token
+// immediately instead of waiting out queryTimeout. id is the value
+// encodeQuery wrote into the query's "t" field, read back out of the
+// matching response's "t" field by decodeTransactionID. It also records the
+// responding contact as freshly seen, since a response is the strongest
+// liveness signal a contact can give regardless of whether it arrived while
+// serving an iterative lookup.
+func (t *transactionManager) complete(id uint64) {
+	t.mu.Lock()
+	txn, ok := t.txns[id]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if txn.remoteID != "" {
+		t.node.touchContact(txn.remoteID)
+	}
+
+	select {
+	case <-txn.done:
+	default:
+		close(txn.done)
+	}
+}
+
+// manage sends a query up to Config.Try times in all, releasing the transaction's
+// worker token as soon as it either completes or ctx is done, instead of
+// always waiting out the full retry/timeout loop.
+func (t *transactionManager) manage(ctx context.Context, txn *transaction, no *node, kind, key string) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.txns, txn.id)
+		t.mu.Unlock()
+		<-t.node.workerTokens
+	}()
+
+	tries := t.node.Try
+	if tries <= 0 {
+		tries = 1
+	}
+
+	for i := 0; i < tries; i++ {
+		t.send(no, kind, txn.id, key)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-txn.done:
+			return
+		case <-time.After(queryTimeout):
+			// no response yet; retry.
+		}
+	}
+}
+
+// send encodes and writes a single KRPC-style query packet to no. This is
+// the only place the package writes a query, and decodeTransactionID (used
+// by listen() to route responses back to complete) is its decode
+// counterpart, reading back exactly the "t" field written here. Errors are
+// swallowed: a dropped packet just means this attempt times out and the
+// caller's retry loop tries again.
+func (t *transactionManager) send(no *node, kind string, id uint64, key string) {
+	if t.node.conn == nil {
+		return
+	}
+	msg := encodeQuery(id, kind, t.node.node.id.RawString(), key)
+	t.node.conn.WriteToUDP(msg, no.addr)
+}
+
+// encodeQuery bencodes a find_node/find_value-style query: its target key,
+// the sender's own node id, the query name, and the transaction id. See
+// decodeTransactionID in dht.go for the matching response-side read of "t".
+func encodeQuery(id uint64, kind, selfID, target string) []byte {
+	txnID := strconv.FormatUint(id, 10)
+
+	var b strings.Builder
+	b.WriteString("d1:a")
+	b.WriteString("d2:id")
+	writeBencodeString(&b, selfID)
+	b.WriteString("6:target")
+	writeBencodeString(&b, target)
+	b.WriteString("e")
+	b.WriteString("1:q")
+	writeBencodeString(&b, kind)
+	b.WriteString("1:t")
+	writeBencodeString(&b, txnID)
+	b.WriteString("1:y1:qe")
+	return []byte(b.String())
+}
+
+func writeBencodeString(b *strings.Builder, s string) {
+	b.WriteString(strconv.Itoa(len(s)))
+	b.WriteByte(':')
+	b.WriteString(s)
+}
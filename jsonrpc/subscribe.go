@@ -0,0 +1,156 @@
+package jsonrpc
+
+import (
+	"context"
+	"time"
+)
+
+// PollInterval is how often a Subscription polls the daemon and diffs
+// successive responses. Subscriptions always poll; there is no push transport.
+const PollInterval = time.Second
+
+// FileProgressEvent reports that a downloading file's progress changed.
+type FileProgressEvent struct {
+	ClaimID      string
+	WrittenBytes uint64
+	TotalBytes   uint64
+}
+
+// ClaimResolvedEvent reports that a subscribed URL resolved to a new claim.
+type ClaimResolvedEvent struct {
+	URL   string
+	Claim ResolveResponseItem
+}
+
+// WalletBalanceEvent reports that the wallet balance changed.
+type WalletBalanceEvent struct {
+	Balance WalletBalanceResponse
+}
+
+// StatusChangedEvent reports that the daemon's status changed.
+type StatusChangedEvent struct {
+	Status StatusResponse
+}
+
+// Subscription delivers typed daemon events on its channels until its
+// context is canceled or Close is called, at which point all channels are
+// closed.
+type Subscription struct {
+	FileProgress  chan FileProgressEvent
+	ClaimResolved chan ClaimResolvedEvent
+	WalletBalance chan WalletBalanceEvent
+	StatusChanged chan StatusChangedEvent
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Close stops the subscription's poller and waits for its channels to drain
+// and close, so callers don't have to keep reading after they're done.
+func (s *Subscription) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Subscribe returns a Subscription that polls file_list, status and
+// wallet_balance on PollInterval, emitting an event on the relevant channel
+// only when the polled value changes from what was last seen. resolveURLs,
+// if given, are re-resolved each tick and emit a ClaimResolvedEvent whenever
+// a URL's resolved claim hex changes. The subscription runs until ctx is
+// canceled or Close is called.
+func (c *Client) Subscribe(ctx context.Context, resolveURLs ...string) *Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		FileProgress:  make(chan FileProgressEvent),
+		ClaimResolved: make(chan ClaimResolvedEvent),
+		WalletBalance: make(chan WalletBalanceEvent),
+		StatusChanged: make(chan StatusChangedEvent),
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+
+	go s.poll(ctx, c, resolveURLs)
+
+	return s
+}
+
+func (s *Subscription) poll(ctx context.Context, c *Client, resolveURLs []string) {
+	defer close(s.done)
+	defer close(s.FileProgress)
+	defer close(s.ClaimResolved)
+	defer close(s.WalletBalance)
+	defer close(s.StatusChanged)
+
+	lastFiles := map[string]File{}
+	lastResolved := map[string]string{}
+	var lastBalance WalletBalanceResponse
+	var lastStatus StatusResponse
+	haveBalance, haveStatus := false, false
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if files, err := c.FileList(); err == nil {
+			for _, f := range files {
+				prev, seen := lastFiles[f.ClaimID]
+				lastFiles[f.ClaimID] = f
+				if seen && prev.WrittenBytes == f.WrittenBytes && prev.TotalBytes == f.TotalBytes {
+					continue
+				}
+				event := FileProgressEvent{ClaimID: f.ClaimID, WrittenBytes: f.WrittenBytes, TotalBytes: f.TotalBytes}
+				select {
+				case s.FileProgress <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		if balance, err := c.WalletBalance(); err == nil && (!haveBalance || balance != lastBalance) {
+			haveBalance = true
+			lastBalance = balance
+			select {
+			case s.WalletBalance <- WalletBalanceEvent{Balance: balance}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if status, err := c.Status(); err == nil && (!haveStatus || status != lastStatus) {
+			haveStatus = true
+			lastStatus = status
+			select {
+			case s.StatusChanged <- StatusChangedEvent{Status: status}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if len(resolveURLs) == 0 {
+			continue
+		}
+
+		resolved, err := c.Resolve(resolveURLs...)
+		if err != nil {
+			continue
+		}
+		for url, item := range resolved {
+			if item.Claim == nil || lastResolved[url] == item.Claim.Hex {
+				continue
+			}
+			lastResolved[url] = item.Claim.Hex
+			select {
+			case s.ClaimResolved <- ClaimResolvedEvent{URL: url, Claim: item}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
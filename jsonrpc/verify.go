@@ -0,0 +1,179 @@
+package jsonrpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"hash"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/go-errors/errors"
+	"github.com/golang/protobuf/proto"
+
+	lbryschema "github.com/lbryio/lbryschema.go/pb"
+)
+
+// pkixPublicKey is the DER SubjectPublicKeyInfo structure LBRY certificate
+// public keys are stored in.
+type pkixPublicKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// ecPointFromPKIX pulls the raw EC point out of a DER SubjectPublicKeyInfo,
+// for curves (like secp256k1) crypto/x509 doesn't know how to parse itself.
+func ecPointFromPKIX(der []byte) ([]byte, error) {
+	var spki pkixPublicKey
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	return spki.PublicKey.RightAlign(), nil
+}
+
+// parsePublicKey decodes a certificate's DER SubjectPublicKeyInfo public key
+// into an *ecdsa.PublicKey on the curve its KeyType specifies. LBRY
+// certificates are almost always SECP256k1 (the bitcoin curve), which
+// crypto/x509 doesn't recognize, so that case is parsed by hand via btcec;
+// NIST256p/NIST384p certificates, minted by other LBRY SDKs, parse natively.
+func parsePublicKey(keyType lbryschema.KeyType, der []byte) (*ecdsa.PublicKey, error) {
+	switch lbryschema.KeyType_name[int32(keyType)] {
+	case "SECP256k1":
+		point, err := ecPointFromPKIX(der)
+		if err != nil {
+			return nil, errors.Errorf("invalid certificate public key: %v", err)
+		}
+		pub, err := btcec.ParsePubKey(point, btcec.S256())
+		if err != nil {
+			return nil, errors.Errorf("invalid certificate public key: %v", err)
+		}
+		return pub.ToECDSA(), nil
+	case "NIST256p", "NIST384p":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, errors.Errorf("invalid certificate public key: %v", err)
+		}
+		ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("certificate public key is not ECDSA")
+		}
+		return ecdsaPub, nil
+	default:
+		return nil, errors.Errorf("unsupported certificate key type: %s", keyType)
+	}
+}
+
+// hashForCurve returns the hash lbryschema signs with for a certificate on
+// curve: sha256 for SECP256k1/NIST256p, sha384 for NIST384p. It's keyed off
+// the curve's bit size rather than KeyType directly since that's what
+// parsePublicKey already resolved down to.
+func hashForCurve(curve elliptic.Curve) func() hash.Hash {
+	if curve.Params().BitSize > 256 {
+		return sha512.New384
+	}
+	return sha256.New
+}
+
+// signedDigest reconstructs the payload a claim's publisher signature was
+// made over: newHash of the claim's decoded address, followed by the claim
+// re-serialized with its signature cleared, followed by the signing
+// certificate's claim id — mirroring lbryschema's to_sign construction.
+func signedDigest(claim *Claim, newHash func() hash.Hash) ([]byte, error) {
+	sig := claim.Value.PublisherSignature
+	if sig == nil {
+		return nil, errors.New("claim has no publisher signature to verify")
+	}
+
+	addr := base58.Decode(claim.Address)
+	if len(addr) == 0 {
+		return nil, errors.Errorf("invalid claim address: %s", claim.Address)
+	}
+
+	certClaimID, err := hex.DecodeString(sig.CertificateId)
+	if err != nil {
+		return nil, errors.Errorf("invalid certificate claim id in signature: %v", err)
+	}
+
+	unsigned := proto.Clone(&claim.Value).(*lbryschema.Claim)
+	unsigned.PublisherSignature = nil
+
+	serialized, err := proto.Marshal(unsigned)
+	if err != nil {
+		return nil, errors.Errorf("failed to re-serialize claim for verification: %v", err)
+	}
+
+	h := newHash()
+	h.Write(addr)
+	h.Write(serialized)
+	h.Write(certClaimID)
+	return h.Sum(nil), nil
+}
+
+// VerifyClaim independently verifies that claim's publisher signature was
+// produced by certificate, without trusting signature_is_valid as reported
+// by a remote lbrynet daemon. It returns nil if the signature checks out,
+// and a descriptive error otherwise.
+func VerifyClaim(claim *Claim, certificate *Claim) error {
+	if claim == nil || certificate == nil {
+		return errors.New("claim and certificate are required")
+	}
+
+	sig := claim.Value.PublisherSignature
+	if sig == nil {
+		return errors.New("claim has no publisher signature to verify")
+	}
+
+	cert := certificate.Value.Certificate
+	if cert == nil {
+		return errors.New("certificate claim has no certificate")
+	}
+
+	pub, err := parsePublicKey(cert.KeyType, cert.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	// LBRY publisher signatures are the raw r||s concatenation, not
+	// ASN.1/DER, with r and s each padded to the curve's coordinate size
+	// (32 bytes for SECP256k1/NIST256p, 48 for NIST384p).
+	coordSize := (pub.Curve.Params().BitSize + 7) / 8
+	if len(sig.Signature) != coordSize*2 {
+		return errors.Errorf("signature has unexpected length %d", len(sig.Signature))
+	}
+	r := new(big.Int).SetBytes(sig.Signature[:coordSize])
+	s := new(big.Int).SetBytes(sig.Signature[coordSize:])
+
+	digest, err := signedDigest(claim, hashForCurve(pub.Curve))
+	if err != nil {
+		return err
+	}
+
+	if !ecdsa.Verify(pub, digest, r, s) {
+		return errors.New("signature is not valid")
+	}
+
+	return nil
+}
+
+// VerifyResolveResponse runs VerifyClaim over every item in resp that carries
+// both a claim and its signing certificate, returning the first verification
+// failure encountered, if any. Call this on the result of a client's Resolve
+// to independently check signature_is_valid without trusting the daemon
+// that reported it.
+func VerifyResolveResponse(resp ResolveResponse) error {
+	for url, item := range resp {
+		if item.Claim == nil || item.Certificate == nil {
+			continue
+		}
+		if err := VerifyClaim(item.Claim, item.Certificate); err != nil {
+			return errors.Errorf("%s: %v", url, err)
+		}
+	}
+	return nil
+}